@@ -0,0 +1,277 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/go-netty/go-netty"
+	"github.com/go-netty/go-netty/codec"
+	"github.com/go-netty/go-netty/utils"
+)
+
+// CompressionAlgo identifies the streaming compression algorithm used by CompressionCodec.
+type CompressionAlgo byte
+
+const (
+	// CompressionNone disables compression, the frame is passed through unchanged.
+	CompressionNone CompressionAlgo = iota
+	// CompressionGzip compresses frames with compress/gzip.
+	CompressionGzip
+	// CompressionZstd compresses frames with zstd.
+	CompressionZstd
+)
+
+// ErrDecompressedTooLarge is returned when decompressing a frame would exceed
+// the configured maxDecompressedSize, guarding against decompression bombs.
+var ErrDecompressedTooLarge = errors.New("frame: decompressed size exceeds limit")
+
+// CompressionCodec create a codec that transparently compresses outbound
+// messages with algo on HandleWrite and decompresses them on HandleRead, so
+// it can be stacked above VarintLengthFieldCodec to get compressed
+// length-delimited frames. maxDecompressedSize bounds the decompressed
+// output to guard against decompression bombs and should be no larger than
+// the outer frame codec's maxFrameLength.
+func CompressionCodec(algo CompressionAlgo, level int, maxDecompressedSize int) codec.Codec {
+	utils.AssertIf(maxDecompressedSize <= 0, "maxDecompressedSize must be a positive integer")
+	return &compressionCodec{
+		algo:                algo,
+		maxDecompressedSize: maxDecompressedSize,
+		gzipWriters:         newGzipWriterPool(level),
+		zstdWriters:         newZstdWriterPool(level),
+		gzipReaders:         newGzipReaderPool(),
+		zstdReaders:         newZstdReaderPool(),
+	}
+}
+
+// TaggedCompressionCodec behaves like CompressionCodec but prefixes every
+// outbound frame with a one-byte algorithm tag, so a single receiver
+// configured with TaggedCompressionCodec can transparently accept frames
+// produced with different algorithms on the same channel.
+func TaggedCompressionCodec(algo CompressionAlgo, level int, maxDecompressedSize int) codec.Codec {
+	c := CompressionCodec(algo, level, maxDecompressedSize).(*compressionCodec)
+	c.tagged = true
+	return c
+}
+
+type compressionCodec struct {
+	algo                CompressionAlgo
+	tagged              bool
+	maxDecompressedSize int
+	gzipWriters         *sync.Pool
+	zstdWriters         *sync.Pool
+	gzipReaders         *sync.Pool
+	zstdReaders         *sync.Pool
+}
+
+func (c *compressionCodec) CodecName() string {
+	return "compression-codec"
+}
+
+func newGzipWriterPool(level int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		w, err := gzip.NewWriterLevel(ioutil.Discard, level)
+		utils.Assert(err)
+		return w
+	}}
+}
+
+func newZstdWriterPool(level int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		w, err := zstd.NewWriter(ioutil.Discard, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		utils.Assert(err)
+		return w
+	}}
+}
+
+// newGzipReaderPool pools *gzip.Reader instances across frames: each use
+// calls Reset(r) rather than allocating a new reader.
+func newGzipReaderPool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		return new(gzip.Reader)
+	}}
+}
+
+// newZstdReaderPool pools *zstd.Decoder instances across frames. A zstd
+// decoder owns background goroutines for its lifetime, so reusing one via
+// Reset(r) instead of creating (and never closing) a new decoder per frame
+// is what keeps HandleRead from leaking a goroutine on every inbound frame.
+func newZstdReaderPool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		zr, err := zstd.NewReader(nil)
+		utils.Assert(err)
+		return zr
+	}}
+}
+
+func (c *compressionCodec) compress(dst io.Writer, src io.Reader, algo CompressionAlgo) {
+	switch algo {
+	case CompressionNone:
+		_, err := io.Copy(dst, src)
+		utils.Assert(err)
+	case CompressionGzip:
+		w := c.gzipWriters.Get().(*gzip.Writer)
+		defer c.gzipWriters.Put(w)
+		w.Reset(dst)
+		_, err := io.Copy(w, src)
+		utils.Assert(err)
+		utils.Assert(w.Close())
+	case CompressionZstd:
+		w := c.zstdWriters.Get().(*zstd.Encoder)
+		defer c.zstdWriters.Put(w)
+		w.Reset(dst)
+		_, err := io.Copy(w, src)
+		utils.Assert(err)
+		utils.Assert(w.Close())
+	default:
+		utils.Assert(fmt.Errorf("unsupported compression algorithm: %d", algo))
+	}
+}
+
+// decompressor returns a reader that releases its pooled decoder back to
+// the relevant sync.Pool as soon as it is exhausted (EOF/error) or Close is
+// called, so a decoder whose downstream consumer never reaches EOF (e.g.
+// limitedReader rejecting a bomb) can still be reclaimed explicitly.
+func (c *compressionCodec) decompressor(r io.Reader, algo CompressionAlgo) io.Reader {
+	switch algo {
+	case CompressionNone:
+		return r
+	case CompressionGzip:
+		gr := c.gzipReaders.Get().(*gzip.Reader)
+		utils.Assert(gr.Reset(r))
+		return &pooledReader{r: gr, release: func() { c.gzipReaders.Put(gr) }}
+	case CompressionZstd:
+		zr := c.zstdReaders.Get().(*zstd.Decoder)
+		utils.Assert(zr.Reset(r))
+		return &pooledReader{r: zr, release: func() { c.zstdReaders.Put(zr) }}
+	default:
+		utils.Assert(fmt.Errorf("unsupported compression algorithm: %d", algo))
+		return nil
+	}
+}
+
+// pooledReader wraps a decoder borrowed from a sync.Pool, returning it to
+// the pool exactly once, either when reading from it fails (including a
+// normal io.EOF) or when Close is called explicitly by a reader that gives
+// up on it early (e.g. limitedReader rejecting a decompression bomb).
+type pooledReader struct {
+	r        io.Reader
+	release  func()
+	released bool
+}
+
+func (p *pooledReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil {
+		p.Close()
+	}
+	return n, err
+}
+
+func (p *pooledReader) Close() error {
+	if !p.released {
+		p.released = true
+		p.release()
+	}
+	return nil
+}
+
+func (c *compressionCodec) HandleWrite(ctx netty.OutboundContext, message netty.Message) {
+
+	var src io.Reader
+	switch r := message.(type) {
+	case []byte:
+		src = bytes.NewReader(r)
+	case io.Reader:
+		src = r
+	default:
+		utils.Assert(fmt.Errorf("unrecognized type: %T", message))
+	}
+
+	var buf bytes.Buffer
+	if c.tagged {
+		buf.WriteByte(byte(c.algo))
+	}
+
+	c.compress(&buf, src, c.algo)
+
+	ctx.HandleWrite(buf.Bytes())
+}
+
+func (c *compressionCodec) HandleRead(ctx netty.InboundContext, message netty.Message) {
+
+	var r io.Reader
+	switch m := message.(type) {
+	case []byte:
+		r = bytes.NewReader(m)
+	case io.Reader:
+		r = m
+	default:
+		utils.Assert(fmt.Errorf("unrecognized type: %T", message))
+	}
+
+	algo := c.algo
+	if c.tagged {
+		var tag [1]byte
+		_, err := io.ReadFull(r, tag[:])
+		utils.Assert(err)
+		algo = CompressionAlgo(tag[0])
+	}
+
+	decompressed := c.decompressor(r, algo)
+	limited := &limitedReader{r: decompressed, max: int64(c.maxDecompressedSize)}
+
+	ctx.HandleRead(limited)
+}
+
+// limitedReader rejects decompressed output once more than max bytes have
+// been produced, guarding against decompression bombs that would otherwise
+// exhaust memory. A decompressed size of exactly max is allowed, matching
+// the ">" (not ">=") semantics used for maxFrameLength elsewhere in this
+// package: it caps each Read to at most one byte past the remaining budget,
+// so reading exactly max bytes reaches EOF cleanly while reading max+1
+// trips ErrDecompressedTooLarge on the read that crosses the line.
+type limitedReader struct {
+	r         io.Reader
+	max       int64
+	readSoFar int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if limit := l.max - l.readSoFar + 1; int64(len(p)) > limit {
+		p = p[:limit]
+	}
+
+	n, err := l.r.Read(p)
+	l.readSoFar += int64(n)
+
+	if l.readSoFar > l.max {
+		if c, ok := l.r.(io.Closer); ok {
+			utils.Assert(c.Close())
+		}
+		return n, ErrDecompressedTooLarge
+	}
+	return n, err
+}
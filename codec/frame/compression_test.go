@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLimitedReaderAllowsExactlyMax(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, 64)
+	l := &limitedReader{r: bytes.NewReader(payload), max: int64(len(payload))}
+
+	got, err := ioutil.ReadAll(l)
+	if err != nil {
+		t.Fatalf("reading exactly max bytes must not error, got %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+func TestLimitedReaderRejectsMaxPlusOne(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, 65)
+	l := &limitedReader{r: bytes.NewReader(payload), max: 64}
+
+	_, err := ioutil.ReadAll(l)
+	if err != ErrDecompressedTooLarge {
+		t.Fatalf("expected ErrDecompressedTooLarge for max+1 bytes, got %v", err)
+	}
+}
+
+func TestCompressionGzipRoundTrip(t *testing.T) {
+	c := CompressionCodec(CompressionGzip, 6, 1<<20).(*compressionCodec)
+
+	original := []byte("the quick brown fox jumps over the lazy dog, repeated: " +
+		"the quick brown fox jumps over the lazy dog")
+
+	var compressed bytes.Buffer
+	c.compress(&compressed, bytes.NewReader(original), CompressionGzip)
+
+	decompressed, err := ioutil.ReadAll(c.decompressor(&compressed, CompressionGzip))
+	if err != nil {
+		t.Fatalf("unexpected error decompressing: %v", err)
+	}
+	if !bytes.Equal(decompressed, original) {
+		t.Fatalf("round-tripped payload mismatch: got %q, want %q", decompressed, original)
+	}
+}
+
+func TestCompressionZstdRoundTrip(t *testing.T) {
+	c := CompressionCodec(CompressionZstd, 3, 1<<20).(*compressionCodec)
+
+	original := []byte("the quick brown fox jumps over the lazy dog, repeated: " +
+		"the quick brown fox jumps over the lazy dog")
+
+	var compressed bytes.Buffer
+	c.compress(&compressed, bytes.NewReader(original), CompressionZstd)
+
+	decompressed, err := ioutil.ReadAll(c.decompressor(&compressed, CompressionZstd))
+	if err != nil {
+		t.Fatalf("unexpected error decompressing: %v", err)
+	}
+	if !bytes.Equal(decompressed, original) {
+		t.Fatalf("round-tripped payload mismatch: got %q, want %q", decompressed, original)
+	}
+}
+
+// TestCompressionTaggedMultiAlgo simulates two peers configured with
+// different write-side algorithms both talking to one TaggedCompressionCodec
+// receiver, the scenario the algorithm tag byte exists for.
+func TestCompressionTaggedMultiAlgo(t *testing.T) {
+	gzipSender := TaggedCompressionCodec(CompressionGzip, 6, 1<<20).(*compressionCodec)
+	zstdSender := TaggedCompressionCodec(CompressionZstd, 3, 1<<20).(*compressionCodec)
+	receiver := TaggedCompressionCodec(CompressionGzip, 6, 1<<20).(*compressionCodec)
+
+	for _, sender := range []*compressionCodec{gzipSender, zstdSender} {
+		original := []byte("payload from " + sender.CodecName())
+
+		var buf bytes.Buffer
+		buf.WriteByte(byte(sender.algo))
+		sender.compress(&buf, bytes.NewReader(original), sender.algo)
+
+		var tag [1]byte
+		if _, err := io.ReadFull(&buf, tag[:]); err != nil {
+			t.Fatalf("unexpected error reading tag: %v", err)
+		}
+
+		got, err := ioutil.ReadAll(receiver.decompressor(&buf, CompressionAlgo(tag[0])))
+		if err != nil {
+			t.Fatalf("unexpected error decompressing tagged frame: %v", err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Fatalf("got %q, want %q", got, original)
+		}
+	}
+}
+
+// TestPooledReaderReleasesExactlyOnce ensures decompressor's pooledReader
+// hands its decoder back on the read that hits EOF/error, and that a
+// subsequent explicit Close (as limitedReader issues on an oversized frame)
+// does not double-release it.
+func TestPooledReaderReleasesExactlyOnce(t *testing.T) {
+	released := 0
+	p := &pooledReader{r: bytes.NewReader([]byte("hi")), release: func() { released++ }}
+
+	buf := make([]byte, 16)
+	for {
+		if _, err := p.Read(buf); err != nil {
+			break
+		}
+	}
+	if released != 1 {
+		t.Fatalf("expected release to be called exactly once on EOF, got %d", released)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error from Close: %v", err)
+	}
+	if released != 1 {
+		t.Fatalf("expected release to remain called exactly once after a redundant Close, got %d", released)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-netty/go-netty"
+	"github.com/go-netty/go-netty/codec"
+	"github.com/go-netty/go-netty/utils"
+)
+
+// streamingParserPhase is the state of streamingVarintLengthFieldCodec's
+// per-connection parser between HandleRead calls.
+type streamingParserPhase int
+
+const (
+	readingHeader streamingParserPhase = iota
+	readingBody
+)
+
+// StreamingVarintLengthFieldCodec create a varint length field codec that
+// does not assume the incoming io.Reader blocks until a whole frame is
+// available. Instead it keeps a small parser state machine and consumes
+// whatever bytes a HandleRead call hands it, emitting a frame downstream
+// only once the full body has arrived. This lets go-netty be plugged into
+// transports that deliver arbitrary byte chunks (QUIC streams, TLS records,
+// in-memory pipes) without a dedicated per-connection reader goroutine.
+//
+// Unlike VarintLengthFieldCodec, HandleRead expects each message to be the
+// []byte chunk the transport just received, not a blocking io.Reader.
+//
+// Unlike the stateless VarintLengthFieldCodec, a streamingVarintLengthFieldCodec
+// carries per-connection parser state (phase, the in-progress header, and
+// the partially-filled body buffer) across calls. One instance must be
+// created per connection; sharing a single instance across connections in a
+// pipeline initializer will interleave their bytes and corrupt both.
+func StreamingVarintLengthFieldCodec(maxFrameLength int) codec.Codec {
+	utils.AssertIf(maxFrameLength <= 0, "maxFrameLength must be a positive integer")
+	return &streamingVarintLengthFieldCodec{
+		maxFrameLength: maxFrameLength,
+		phase:          readingHeader,
+	}
+}
+
+type streamingVarintLengthFieldCodec struct {
+	maxFrameLength int
+	phase          streamingParserPhase
+
+	header []byte // accumulated varint header bytes, reset once decoded
+
+	frameLength int
+	body        []byte // pre-sized to frameLength, filled as bytes arrive
+	bodyFilled  int
+}
+
+func (s *streamingVarintLengthFieldCodec) CodecName() string {
+	return "streaming-varint-length-field-codec"
+}
+
+func (s *streamingVarintLengthFieldCodec) checkFrameLength(frameLength uint64) {
+	utils.AssertIf(frameLength > uint64(maxInt),
+		"frame length overflows int, frameLength(%d)", frameLength)
+	utils.AssertIf(frameLength > uint64(s.maxFrameLength),
+		"frame length too large, frameLength(%d) > maxFrameLength(%d)", frameLength, s.maxFrameLength)
+}
+
+func (s *streamingVarintLengthFieldCodec) HandleRead(ctx netty.InboundContext, message netty.Message) {
+
+	chunk, ok := message.([]byte)
+	utils.AssertIf(!ok, "unrecognized type: %T", message)
+
+	for len(chunk) > 0 {
+		switch s.phase {
+		case readingHeader:
+			chunk = s.consumeHeader(chunk)
+		case readingBody:
+			var frame []byte
+			frame, chunk = s.consumeBody(chunk)
+			if nil != frame {
+				ctx.HandleRead(bytes.NewReader(frame))
+			}
+		}
+	}
+}
+
+// consumeHeader accumulates header bytes one at a time, attempting
+// binary.Uvarint after each append, until the full varint decodes or
+// MaxVarintLen64 bytes have been accumulated without success. It returns
+// whatever of chunk it did not need.
+func (s *streamingVarintLengthFieldCodec) consumeHeader(chunk []byte) (rest []byte) {
+
+	for len(chunk) > 0 {
+		utils.AssertIf(len(s.header) >= binary.MaxVarintLen64, "frame: corrupt varint header")
+
+		s.header = append(s.header, chunk[0])
+		chunk = chunk[1:]
+
+		frameLength, n := binary.Uvarint(s.header)
+		if n == 0 {
+			// need more data
+			continue
+		}
+		utils.AssertIf(n < 0, "frame: corrupt varint header")
+
+		s.checkFrameLength(frameLength)
+
+		s.header = s.header[:0]
+		s.frameLength = int(frameLength)
+		s.body = make([]byte, s.frameLength)
+		s.bodyFilled = 0
+		s.phase = readingBody
+		return chunk
+	}
+
+	return chunk
+}
+
+// consumeBody copies as much of chunk into the pre-sized body buffer as is
+// needed to complete it, returning the finished frame (nil if still
+// incomplete) and whatever of chunk it did not need.
+func (s *streamingVarintLengthFieldCodec) consumeBody(chunk []byte) (frame []byte, rest []byte) {
+
+	n := copy(s.body[s.bodyFilled:], chunk)
+	s.bodyFilled += n
+	rest = chunk[n:]
+
+	if s.bodyFilled < s.frameLength {
+		return nil, rest
+	}
+
+	frame = s.body
+	s.body = nil
+	s.bodyFilled = 0
+	s.frameLength = 0
+	s.phase = readingHeader
+
+	return frame, rest
+}
+
+func (s *streamingVarintLengthFieldCodec) HandleWrite(ctx netty.OutboundContext, message netty.Message) {
+
+	var bodyBytes []byte
+
+	switch r := message.(type) {
+	case []byte:
+		bodyBytes = r
+	case io.Reader:
+		bodyBytes = utils.AssertBytes(ioutil.ReadAll(r))
+	default:
+		utils.Assert(fmt.Errorf("unrecognized type: %T", message))
+	}
+
+	utils.AssertIf(len(bodyBytes) > s.maxFrameLength,
+		"frame length too large, frameLength(%d) > maxFrameLength(%d)", len(bodyBytes), s.maxFrameLength)
+
+	// encode header
+	var head = [binary.MaxVarintLen64]byte{}
+	n := binary.PutUvarint(head[:], uint64(len(bodyBytes)))
+
+	// Optimize one merge operation to reduce memory allocation.
+	ctx.HandleWrite([][]byte{
+		// header
+		head[:n],
+		// payload
+		bodyBytes,
+	})
+}
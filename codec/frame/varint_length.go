@@ -19,46 +19,147 @@ package frame
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"time"
 
 	"github.com/go-netty/go-netty"
 	"github.com/go-netty/go-netty/codec"
 	"github.com/go-netty/go-netty/utils"
 )
 
+// maxInt is the largest value representable by int on the current platform,
+// used to detect uint64 frame lengths that would silently truncate when
+// cast to int on 32-bit platforms.
+const maxInt = int(^uint(0) >> 1)
+
+// ErrShortFrame is returned when the reader reaches EOF before delivering the
+// number of bytes declared by the frame header, or when a []byte message's
+// body length differs from the declared length. A body that stalls instead
+// fails with ErrReadTimeout when WithReadTimeout is set.
+var ErrShortFrame = errors.New("frame: short frame")
+
+// ErrReadTimeout is returned when the frame body does not finish arriving
+// within the configured read timeout, e.g. a slow-loris peer that sends the
+// header then withholds the body to pin memory.
+var ErrReadTimeout = errors.New("frame: read timeout")
+
+// Option configures optional behaviour of VarintLengthFieldCodec.
+type Option func(*varintLengthFieldCodec)
+
+// WithMinFrameLength rejects frames smaller than minFrameLength before any
+// allocation happens, so obviously-corrupt zero-length or absurdly-small
+// frames are dropped early.
+func WithMinFrameLength(minFrameLength int) Option {
+	return func(v *varintLengthFieldCodec) {
+		v.minFrameLength = minFrameLength
+	}
+}
+
+// WithReadTimeout bounds how long HandleRead will wait for the full frame
+// body to arrive once its length has been decoded. A stalled peer that
+// never completes the body returns ErrReadTimeout instead of letting the
+// reader pin up to maxFrameLength bytes of memory indefinitely.
+//
+// When the underlying reader does not support SetReadDeadline (see
+// readDeadliner), enforcing the timeout requires racing a goroutine against
+// the deadline; that goroutine is abandoned, not joined, on timeout, so a
+// reader that never unblocks leaks one goroutine per stalled frame. This is
+// harmless for the net.Conn readers go-netty transports normally hand in,
+// which take the SetReadDeadline path instead, but to avoid silently
+// accumulating goroutines against any other reader under attack, that
+// fallback only runs when WithBlockingReaderFallback is also set; otherwise
+// HandleRead fails fast with ErrBlockingReaderUnsupported.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(v *varintLengthFieldCodec) {
+		v.readTimeout = timeout
+	}
+}
+
+// WithBlockingReaderFallback opts into enforcing WithReadTimeout against
+// readers that do not implement readDeadliner (i.e. are not backed by a
+// real connection) by racing their blocking Read in a goroutine. See
+// WithReadTimeout for why this is opt-in: the goroutine is abandoned, not
+// joined, on timeout, so a reader that never unblocks leaks one goroutine
+// per stalled frame.
+func WithBlockingReaderFallback() Option {
+	return func(v *varintLengthFieldCodec) {
+		v.allowBlockingFallback = true
+	}
+}
+
 // VarintLengthFieldCodec create varint length field based codec
-func VarintLengthFieldCodec(maxFrameLength int) codec.Codec {
+func VarintLengthFieldCodec(maxFrameLength int, opts ...Option) codec.Codec {
 	utils.AssertIf(maxFrameLength <= 0, "maxFrameLength must be a positive integer")
-	return &varintLengthFieldCodec{
+
+	v := &varintLengthFieldCodec{
 		maxFrameLength: maxFrameLength,
 	}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	return v
 }
 
 type varintLengthFieldCodec struct {
-	maxFrameLength int
+	maxFrameLength        int
+	minFrameLength        int
+	readTimeout           time.Duration
+	allowBlockingFallback bool
 }
 
 func (v *varintLengthFieldCodec) CodecName() string {
 	return "varint-length-field-codec"
 }
 
+// checkFrameLength validates a decoded frame length before it is used to
+// size a buffer: it must fit in an int (the uint64 -> int cast used for the
+// minFrameLength comparison below and by HandleRead silently wraps on 32-bit
+// platforms otherwise), and it must fall within [minFrameLength, maxFrameLength].
+func (v *varintLengthFieldCodec) checkFrameLength(frameLength uint64) {
+	utils.AssertIf(frameLength > uint64(maxInt),
+		"frame length overflows int, frameLength(%d)", frameLength)
+	utils.AssertIf(int(frameLength) < v.minFrameLength,
+		"frame length too small, frameLength(%d) < minFrameLength(%d)", frameLength, v.minFrameLength)
+	utils.AssertIf(frameLength > uint64(v.maxFrameLength),
+		"frame length too large, frameLength(%d) > maxFrameLength(%d)", frameLength, v.maxFrameLength)
+}
+
 func (v *varintLengthFieldCodec) HandleRead(ctx netty.InboundContext, message netty.Message) {
 
 	switch r := message.(type) {
 	case io.Reader:
 		frameLength, err := binary.ReadUvarint(utils.NewByteReader(r))
 		utils.Assert(err)
-		utils.AssertIf(frameLength > uint64(v.maxFrameLength),
-			"frame length too large, frameLength(%d) > maxFrameLength(%d)", frameLength, v.maxFrameLength)
+		v.checkFrameLength(frameLength)
+
+		var timed io.Reader = r
+		if v.readTimeout > 0 {
+			// Wrap r, not the io.LimitReader below: timeoutReader needs to
+			// see the raw reader to find a readDeadliner on it, since
+			// *io.LimitedReader never forwards SetReadDeadline itself.
+			timed = newTimeoutReader(r, v.readTimeout, v.allowBlockingFallback)
+		}
+		limited := io.LimitReader(timed, int64(frameLength))
 
-		ctx.HandleRead(io.LimitReader(r, int64(frameLength)))
+		body := utils.AssertBytes(ioutil.ReadAll(limited))
+		if uint64(len(body)) != frameLength {
+			utils.Assert(fmt.Errorf("%w: expected %d bytes, got %d", ErrShortFrame, frameLength, len(body)))
+		}
+
+		ctx.HandleRead(bytes.NewReader(body))
 	case []byte:
 		frameLength, n := binary.Uvarint(r)
-		utils.AssertIf(frameLength > uint64(v.maxFrameLength),
-			"frame length too large, frameLength(%d) > maxFrameLength(%d)", frameLength, v.maxFrameLength)
-		utils.AssertIf(int(frameLength) != len(r)-n, "incomplete packet")
+		v.checkFrameLength(frameLength)
+		if int(frameLength) != len(r)-n {
+			utils.Assert(fmt.Errorf("%w: expected %d bytes, got %d", ErrShortFrame, frameLength, len(r)-n))
+		}
 
 		ctx.HandleRead(bytes.NewReader(r[n:]))
 	default:
@@ -95,3 +196,93 @@ func (v *varintLengthFieldCodec) HandleWrite(ctx netty.OutboundContext, message
 	})
 
 }
+
+// readDeadliner is implemented by readers backed by a real connection (e.g.
+// net.Conn) that can be given an absolute deadline directly.
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// ErrBlockingReaderUnsupported is returned when WithReadTimeout is
+// configured but the underlying reader neither supports SetReadDeadline nor
+// has opted into the blocking-reader fallback via WithBlockingReaderFallback.
+var ErrBlockingReaderUnsupported = errors.New("frame: reader does not support a read deadline; set WithBlockingReaderFallback to allow the goroutine-racing fallback")
+
+// timeoutReader enforces a single deadline across the whole frame body, not
+// a per-Read timer, so a drip-feed peer that trickles in a byte at a time
+// forever still gets cut off once the frame as a whole has taken too long.
+//
+// When the underlying reader supports SetReadDeadline, that is used
+// directly and Read never blocks past the deadline. Otherwise, if
+// allowBlockingFallback is set, Read falls back to racing the underlying
+// (potentially unbounded) blocking Read against the deadline in a
+// goroutine; on timeout that goroutine is abandoned rather than joined, so
+// it reads into its own private buffer instead of the caller's p to avoid
+// handing a still-live write into a buffer the caller has moved past. This
+// leaks one goroutine per stalled frame for a reader that never unblocks,
+// so it is opt-in: without allowBlockingFallback, Read fails fast with
+// ErrBlockingReaderUnsupported instead.
+func newTimeoutReader(r io.Reader, timeout time.Duration, allowBlockingFallback bool) io.Reader {
+	return &timeoutReader{r: r, deadline: time.Now().Add(timeout), allowBlockingFallback: allowBlockingFallback}
+}
+
+type timeoutReader struct {
+	r                     io.Reader
+	deadline              time.Time
+	allowBlockingFallback bool
+}
+
+// isTimeout reports whether err is the kind of error SetReadDeadline
+// produces once its deadline passes, so the deadline path can surface the
+// same ErrReadTimeout the goroutine-fallback path already guarantees
+// instead of leaking the underlying net.Error/os.ErrDeadlineExceeded.
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if dr, ok := t.r.(readDeadliner); ok {
+		utils.Assert(dr.SetReadDeadline(t.deadline))
+		n, err := t.r.Read(p)
+		if isTimeout(err) {
+			return n, ErrReadTimeout
+		}
+		return n, err
+	}
+
+	remaining := time.Until(t.deadline)
+	if remaining <= 0 {
+		return 0, ErrReadTimeout
+	}
+
+	if !t.allowBlockingFallback {
+		return 0, ErrBlockingReaderUnsupported
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// Read into a private buffer: if the timeout wins the race below, this
+	// goroutine is abandoned still holding a reference to buf, not p, so a
+	// late write from it can never race with the caller reusing p.
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := t.r.Read(buf)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-time.After(remaining):
+		return 0, ErrReadTimeout
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/utils"
+)
+
+func TestVarintCheckFrameLengthBounds(t *testing.T) {
+	v := VarintLengthFieldCodec(1024, WithMinFrameLength(4)).(*varintLengthFieldCodec)
+
+	mustPanic(t, "frame smaller than minFrameLength", func() {
+		v.checkFrameLength(3)
+	})
+	mustPanic(t, "frame larger than maxFrameLength", func() {
+		v.checkFrameLength(1025)
+	})
+	mustPanic(t, "frame length overflowing int", func() {
+		v.checkFrameLength(uint64(maxInt) + 1)
+	})
+
+	// exactly minFrameLength and exactly maxFrameLength must both pass.
+	v.checkFrameLength(4)
+	v.checkFrameLength(1024)
+}
+
+// dripFeedReader hands back n bytes per Read call, sleeping delay before
+// each one, simulating a slow-loris peer that stays just under a per-call
+// timeout forever while never completing a whole-frame deadline.
+type dripFeedReader struct {
+	remaining int
+	perRead   int
+	delay     time.Duration
+}
+
+func (d *dripFeedReader) Read(p []byte) (int, error) {
+	if d.remaining == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(d.delay)
+
+	n := d.perRead
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > d.remaining {
+		n = d.remaining
+	}
+	for i := 0; i < n; i++ {
+		p[i] = 'x'
+	}
+	d.remaining -= n
+	return n, nil
+}
+
+func TestTimeoutReaderCatchesDripFeed(t *testing.T) {
+	// Each individual Read completes well within the timeout, but the
+	// stream as a whole takes far longer than it - a single per-call timer
+	// would never trip.
+	src := &dripFeedReader{remaining: 100, perRead: 1, delay: 5 * time.Millisecond}
+	r := newTimeoutReader(src, 20*time.Millisecond, true)
+
+	_, err := ioutil.ReadAll(r)
+	if err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout for a drip-feed peer, got %v", err)
+	}
+}
+
+func TestTimeoutReaderSucceedsWithinDeadline(t *testing.T) {
+	src := bytes.NewReader([]byte("hello world"))
+	r := newTimeoutReader(src, time.Second, true)
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("got %q, want %q", got, "hello world")
+	}
+}
+
+// TestTimeoutReaderRejectsBlockingReaderWithoutOptIn checks that a reader
+// which supports neither SetReadDeadline nor the blocking-reader fallback
+// opt-in fails fast instead of spawning the goroutine that would otherwise
+// leak if the reader never unblocks.
+func TestTimeoutReaderRejectsBlockingReaderWithoutOptIn(t *testing.T) {
+	src := bytes.NewReader([]byte("hello world"))
+	r := newTimeoutReader(src, time.Second, false)
+
+	_, err := ioutil.ReadAll(r)
+	if err != ErrBlockingReaderUnsupported {
+		t.Fatalf("expected ErrBlockingReaderUnsupported, got %v", err)
+	}
+}
+
+// deadlineConn implements readDeadliner so timeoutReader takes the direct
+// SetReadDeadline path instead of spawning a goroutine.
+type deadlineConn struct {
+	io.Reader
+	deadlines []time.Time
+}
+
+func (d *deadlineConn) SetReadDeadline(t time.Time) error {
+	d.deadlines = append(d.deadlines, t)
+	return nil
+}
+
+func TestTimeoutReaderPrefersSetReadDeadline(t *testing.T) {
+	conn := &deadlineConn{Reader: bytes.NewReader([]byte("abc"))}
+	r := newTimeoutReader(conn, time.Second, false)
+
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conn.deadlines) == 0 {
+		t.Fatal("expected timeoutReader to call SetReadDeadline on a reader that supports it")
+	}
+}
+
+// timeoutConn implements readDeadliner and, once its deadline has passed,
+// returns an error satisfying net.Error.Timeout() - the error shape a real
+// net.Conn produces after SetReadDeadline expires.
+type timeoutConn struct {
+	deadline time.Time
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if !time.Now().Before(c.deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return 0, nil
+}
+
+func TestTimeoutReaderRemapsDeadlineExceeded(t *testing.T) {
+	conn := &timeoutConn{}
+	r := newTimeoutReader(conn, -time.Millisecond, false)
+
+	_, err := r.Read(make([]byte, 16))
+	if err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout on the SetReadDeadline path, got %v", err)
+	}
+}
+
+// TestHandleReadUsesSetReadDeadlineOnRealReader drives HandleRead itself,
+// not newTimeoutReader directly, with a WithReadTimeout codec reading off a
+// readDeadliner-backed reader (standing in for a net.Conn). It exists to
+// catch the bug where wrapping io.LimitReader's output in newTimeoutReader,
+// instead of the other way around, hides the deadliner from timeoutReader
+// and silently falls back to (or, without WithBlockingReaderFallback,
+// rejects) the blocking-reader path even on a real connection.
+func TestHandleReadUsesSetReadDeadlineOnRealReader(t *testing.T) {
+	v := VarintLengthFieldCodec(1024, WithReadTimeout(time.Second)).(*varintLengthFieldCodec)
+
+	body := []byte("hello world")
+	var head [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], uint64(len(body)))
+	wire := append(append([]byte{}, head[:n]...), body...)
+
+	conn := &deadlineConn{Reader: bytes.NewReader(wire)}
+	ctx := &fakeHandlerContext{}
+
+	v.HandleRead(ctx, conn)
+
+	if len(conn.deadlines) == 0 {
+		t.Fatal("expected HandleRead to call SetReadDeadline on a reader that supports it, not fall back to the blocking-reader path")
+	}
+	if len(ctx.reads) != 1 {
+		t.Fatalf("expected exactly one frame handed upstream, got %d", len(ctx.reads))
+	}
+	got := utils.AssertBytes(ioutil.ReadAll(ctx.reads[0].(io.Reader)))
+	if !bytes.Equal(got, body) {
+		t.Fatalf("got %q, want %q", got, body)
+	}
+}
+
+func TestHandleReadRejectsShortByteFrame(t *testing.T) {
+	v := VarintLengthFieldCodec(1024).(*varintLengthFieldCodec)
+
+	// varint(10) followed by only 3 body bytes.
+	frame := append([]byte{10}, []byte("abc")...)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a short-frame panic for a truncated []byte frame")
+		}
+	}()
+	v.HandleRead(nil, frame)
+}
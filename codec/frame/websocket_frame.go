@@ -0,0 +1,318 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-netty/go-netty"
+	"github.com/go-netty/go-netty/codec"
+	"github.com/go-netty/go-netty/utils"
+)
+
+// WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+)
+
+// WebSocketMessageType identifies the kind of message delivered by WebSocketFrameCodec.
+type WebSocketMessageType int
+
+const (
+	WebSocketText WebSocketMessageType = iota
+	WebSocketBinary
+	WebSocketPing
+	WebSocketPong
+	WebSocketClose
+)
+
+// WebSocketMessage is the typed message exchanged through a pipeline that
+// uses WebSocketFrameCodec. Control messages (WebSocketPing, WebSocketPong,
+// WebSocketClose) are delivered out-of-band from WebSocketText/WebSocketBinary
+// data messages, so a dedicated inbound handler can react to a ping without
+// interfering with the data message stream.
+type WebSocketMessage struct {
+	Type    WebSocketMessageType
+	Payload []byte
+}
+
+// WebSocketRole selects which side of the RFC 6455 handshake this codec
+// plays. The role decides whether outbound frames are masked and whether
+// inbound frames are required to be masked.
+type WebSocketRole int
+
+const (
+	// WebSocketServer masks nothing on write and requires masked frames on read.
+	WebSocketServer WebSocketRole = iota
+	// WebSocketClient masks every frame on write and requires unmasked frames on read.
+	WebSocketClient
+)
+
+// WebSocketOption configures optional behaviour of WebSocketFrameCodec.
+type WebSocketOption func(*webSocketFrameCodec)
+
+// WithWebSocketRole sets which side of the connection this codec represents.
+// The default role is WebSocketServer.
+func WithWebSocketRole(role WebSocketRole) WebSocketOption {
+	return func(w *webSocketFrameCodec) {
+		w.role = role
+	}
+}
+
+// ErrControlFrameTooLarge is returned when a ping/pong/close frame declares
+// a payload larger than the 125 bytes permitted by RFC 6455 section 5.5.
+var ErrControlFrameTooLarge = errors.New("frame: websocket control frame too large")
+
+// ErrMaskMismatch is returned when a peer's masking does not match what its
+// role requires: clients must receive unmasked frames, servers must receive
+// masked frames.
+var ErrMaskMismatch = errors.New("frame: websocket mask mismatch")
+
+// ErrFragmentedControlFrame is returned when a ping/pong/close frame arrives
+// with FIN unset. RFC 6455 section 5.5 forbids fragmenting control frames.
+var ErrFragmentedControlFrame = errors.New("frame: websocket control frame must not be fragmented")
+
+// ErrReservedOpcode is returned when a frame declares one of the opcodes
+// RFC 6455 section 11.8 reserves for future extensions.
+var ErrReservedOpcode = errors.New("frame: websocket reserved opcode")
+
+// WebSocketFrameCodec create a codec that speaks RFC 6455 WebSocket framing
+// at the same layer as the existing length-field codecs, so a go-netty
+// pipeline can terminate WebSocket connections without pulling in
+// gorilla/websocket. Fragmented messages are reassembled up to
+// maxFrameLength; control frames (ping/pong/close) are delivered as their
+// own WebSocketMessage as soon as they are read.
+func WebSocketFrameCodec(maxFrameLength int, opts ...WebSocketOption) codec.Codec {
+	utils.AssertIf(maxFrameLength <= 0, "maxFrameLength must be a positive integer")
+
+	w := &webSocketFrameCodec{
+		maxFrameLength: maxFrameLength,
+		role:           WebSocketServer,
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
+}
+
+type webSocketFrameCodec struct {
+	maxFrameLength int
+	role           WebSocketRole
+}
+
+func (w *webSocketFrameCodec) CodecName() string {
+	return "websocket-frame-codec"
+}
+
+func (w *webSocketFrameCodec) HandleRead(ctx netty.InboundContext, message netty.Message) {
+
+	r, ok := message.(io.Reader)
+	utils.AssertIf(!ok, "unrecognized type: %T", message)
+
+	var fragments bytes.Buffer
+	var dataOpcode byte
+
+	for {
+		fin, opcode, payload := w.readFrame(r)
+
+		switch opcode {
+		case wsOpPing:
+			ctx.HandleRead(&WebSocketMessage{Type: WebSocketPing, Payload: payload})
+			continue
+		case wsOpPong:
+			ctx.HandleRead(&WebSocketMessage{Type: WebSocketPong, Payload: payload})
+			continue
+		case wsOpClose:
+			ctx.HandleRead(&WebSocketMessage{Type: WebSocketClose, Payload: payload})
+			return
+		}
+
+		if opcode != wsOpContinuation {
+			dataOpcode = opcode
+		}
+
+		utils.AssertIf(fragments.Len()+len(payload) > w.maxFrameLength,
+			"frame length too large, frameLength(%d) > maxFrameLength(%d)", fragments.Len()+len(payload), w.maxFrameLength)
+		fragments.Write(payload)
+
+		if fin {
+			msgType := WebSocketBinary
+			if dataOpcode == wsOpText {
+				msgType = WebSocketText
+			}
+			ctx.HandleRead(&WebSocketMessage{Type: msgType, Payload: fragments.Bytes()})
+			return
+		}
+	}
+}
+
+// readFrame reads exactly one physical WebSocket frame off r, unmasking the
+// payload in place when a mask key is present.
+func (w *webSocketFrameCodec) readFrame(r io.Reader) (fin bool, opcode byte, payload []byte) {
+
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	utils.Assert(err)
+
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	payloadLen := uint64(head[1] & 0x7F)
+
+	switch payloadLen {
+	case 126:
+		var ext [2]byte
+		_, err := io.ReadFull(r, ext[:])
+		utils.Assert(err)
+		payloadLen = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err := io.ReadFull(r, ext[:])
+		utils.Assert(err)
+		payloadLen = binary.BigEndian.Uint64(ext[:])
+	}
+
+	utils.AssertIf(payloadLen > uint64(maxInt),
+		"frame length overflows int, frameLength(%d)", payloadLen)
+
+	isControl := opcode == wsOpPing || opcode == wsOpPong || opcode == wsOpClose
+	if isControl {
+		utils.AssertIf(!fin, "%v: opcode(%#x)", ErrFragmentedControlFrame, opcode)
+		utils.AssertIf(payloadLen > 125,
+			"%v: frameLength(%d) > 125", ErrControlFrameTooLarge, payloadLen)
+	} else {
+		utils.AssertIf(opcode != wsOpContinuation && opcode != wsOpText && opcode != wsOpBinary,
+			"%v: opcode(%#x)", ErrReservedOpcode, opcode)
+		utils.AssertIf(payloadLen > uint64(w.maxFrameLength),
+			"frame length too large, frameLength(%d) > maxFrameLength(%d)", payloadLen, w.maxFrameLength)
+	}
+
+	if w.role == WebSocketServer {
+		utils.AssertIf(!masked, "%v: frame from client must be masked", ErrMaskMismatch)
+	} else {
+		utils.AssertIf(masked, "%v: frame from server must not be masked", ErrMaskMismatch)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		_, err := io.ReadFull(r, maskKey[:])
+		utils.Assert(err)
+	}
+
+	body := utils.AssertBytes(ioutil.ReadAll(io.LimitReader(r, int64(payloadLen))))
+	if uint64(len(body)) != payloadLen {
+		utils.Assert(fmt.Errorf("%w: expected %d bytes, got %d", ErrShortFrame, payloadLen, len(body)))
+	}
+
+	if masked {
+		for i := range body {
+			body[i] ^= maskKey[i%4]
+		}
+	}
+
+	return fin, opcode, body
+}
+
+func (w *webSocketFrameCodec) HandleWrite(ctx netty.OutboundContext, message netty.Message) {
+
+	msg, ok := message.(*WebSocketMessage)
+	utils.AssertIf(!ok, "unrecognized type: %T", message)
+
+	utils.AssertIf(len(msg.Payload) > w.maxFrameLength,
+		"frame length too large, frameLength(%d) > maxFrameLength(%d)", len(msg.Payload), w.maxFrameLength)
+
+	var opcode byte
+	switch msg.Type {
+	case WebSocketText:
+		opcode = wsOpText
+	case WebSocketBinary:
+		opcode = wsOpBinary
+	case WebSocketPing:
+		opcode = wsOpPing
+	case WebSocketPong:
+		opcode = wsOpPong
+	case WebSocketClose:
+		opcode = wsOpClose
+	default:
+		utils.Assert(fmt.Errorf("unrecognized websocket message type: %v", msg.Type))
+	}
+
+	if opcode == wsOpPing || opcode == wsOpPong || opcode == wsOpClose {
+		utils.AssertIf(len(msg.Payload) > 125,
+			"%v: frameLength(%d) > 125", ErrControlFrameTooLarge, len(msg.Payload))
+	}
+
+	ctx.HandleWrite(w.encodeFrame(opcode, msg.Payload))
+}
+
+// encodeFrame builds a single, unfragmented RFC 6455 frame, masking the
+// payload when this codec plays the client role.
+func (w *webSocketFrameCodec) encodeFrame(opcode byte, payload []byte) []byte {
+
+	var head bytes.Buffer
+	head.WriteByte(0x80 | opcode) // FIN always set, go-netty never sends fragmented frames
+
+	masked := w.role == WebSocketClient
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		head.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		head.WriteByte(maskBit | 126)
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(len(payload)))
+		head.Write(ext[:])
+	default:
+		head.WriteByte(maskBit | 127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		head.Write(ext[:])
+	}
+
+	if !masked {
+		return append(head.Bytes(), payload...)
+	}
+
+	var maskKey [4]byte
+	_, err := rand.Read(maskKey[:])
+	utils.Assert(err)
+	head.Write(maskKey[:])
+
+	maskedPayload := make([]byte, len(payload))
+	for i := range payload {
+		maskedPayload[i] = payload[i] ^ maskKey[i%4]
+	}
+
+	return append(head.Bytes(), maskedPayload...)
+}
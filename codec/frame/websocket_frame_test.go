@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frame
+
+import (
+	"bytes"
+	"testing"
+)
+
+// encodeFragment builds a single physical WebSocket frame with an explicit
+// FIN bit, for constructing fragmented test messages. Production code never
+// needs this since encodeFrame always sends unfragmented messages.
+func (w *webSocketFrameCodec) encodeFragment(fin bool, opcode byte, payload []byte) []byte {
+	frame := w.encodeFrame(opcode, payload)
+	if !fin {
+		frame[0] &^= 0x80
+	}
+	return frame
+}
+
+func TestWebSocketClientFramesAreMasked(t *testing.T) {
+	w := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+
+	payload := []byte("hello")
+	encoded := w.encodeFrame(wsOpText, payload)
+
+	if encoded[1]&0x80 == 0 {
+		t.Fatal("client frames must set the mask bit")
+	}
+}
+
+func TestWebSocketServerFramesAreNotMasked(t *testing.T) {
+	w := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+
+	payload := []byte("hello")
+	encoded := w.encodeFrame(wsOpText, payload)
+
+	if encoded[1]&0x80 != 0 {
+		t.Fatal("server frames must not set the mask bit")
+	}
+}
+
+// TestWebSocketMaskRoundTrip encodes a masked (client-role) frame and
+// verifies a server-role codec's readFrame unmasks it back to the original
+// payload.
+func TestWebSocketMaskRoundTrip(t *testing.T) {
+	client := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+
+	payload := []byte("the lazy dog")
+	encoded := client.encodeFrame(wsOpBinary, payload)
+
+	fin, opcode, got := server.readFrame(bytes.NewReader(encoded))
+	if !fin {
+		t.Fatal("expected FIN to be set for an unfragmented frame")
+	}
+	if opcode != wsOpBinary {
+		t.Fatalf("got opcode %#x, want %#x", opcode, wsOpBinary)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+func TestWebSocketMaskMismatchRejected(t *testing.T) {
+	// A server codec must reject an unmasked frame, as if it came from
+	// another server rather than a client.
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+	unmasked := server.encodeFrame(wsOpText, []byte("hi")) // role Server never masks
+
+	mustPanic(t, "unmasked frame received by a server", func() {
+		server.readFrame(bytes.NewReader(unmasked))
+	})
+}
+
+// TestWebSocketFragmentReassembly manually builds a two-part fragmented
+// text message (an initial frame with FIN=0 followed by a FIN=1
+// continuation frame) and checks readFrame parses each physical frame
+// correctly so the caller can reassemble them, mirroring what HandleRead
+// does internally.
+func TestWebSocketFragmentReassembly(t *testing.T) {
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+	client := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+
+	first := client.encodeFragment(false, wsOpText, []byte("hello "))
+	second := client.encodeFragment(true, wsOpContinuation, []byte("world"))
+
+	var stream bytes.Buffer
+	stream.Write(first)
+	stream.Write(second)
+
+	fin1, op1, part1 := server.readFrame(&stream)
+	if fin1 {
+		t.Fatal("first fragment must not have FIN set")
+	}
+	if op1 != wsOpText {
+		t.Fatalf("first fragment opcode = %#x, want %#x", op1, wsOpText)
+	}
+
+	fin2, op2, part2 := server.readFrame(&stream)
+	if !fin2 {
+		t.Fatal("final fragment must have FIN set")
+	}
+	if op2 != wsOpContinuation {
+		t.Fatalf("continuation opcode = %#x, want %#x", op2, wsOpContinuation)
+	}
+
+	full := append(append([]byte{}, part1...), part2...)
+	if string(full) != "hello world" {
+		t.Fatalf("reassembled message = %q, want %q", full, "hello world")
+	}
+}
+
+func TestWebSocketControlFrameTooLarge(t *testing.T) {
+	w := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+	oversized := w.encodeFragment(true, wsOpPing, bytes.Repeat([]byte{0}, 126))
+
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+	mustPanic(t, "ping frame with payload > 125 bytes", func() {
+		server.readFrame(bytes.NewReader(oversized))
+	})
+}
+
+// TestWebSocketFragmentedControlFrameRejected checks that a ping frame with
+// FIN unset is rejected, per RFC 6455 section 5.5's ban on fragmenting
+// control frames.
+func TestWebSocketFragmentedControlFrameRejected(t *testing.T) {
+	w := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+	fragmented := w.encodeFragment(false, wsOpPing, []byte("ping"))
+
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+	mustPanic(t, "ping frame with FIN unset", func() {
+		server.readFrame(bytes.NewReader(fragmented))
+	})
+}
+
+// TestWebSocketReservedOpcodeRejected checks that a data frame declaring one
+// of the opcodes RFC 6455 section 11.8 reserves for future extensions is
+// rejected rather than silently dispatched.
+func TestWebSocketReservedOpcodeRejected(t *testing.T) {
+	w := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketClient)).(*webSocketFrameCodec)
+	reserved := w.encodeFragment(true, 0x3, []byte("data"))
+
+	server := WebSocketFrameCodec(1<<16, WithWebSocketRole(WebSocketServer)).(*webSocketFrameCodec)
+	mustPanic(t, "reserved data opcode 0x3", func() {
+		server.readFrame(bytes.NewReader(reserved))
+	})
+}
+
+// TestWebSocketHandleWriteRejectsOversizedControlFrame checks the write-side
+// mirror of TestWebSocketControlFrameTooLarge: HandleWrite must not let a
+// caller emit an on-the-wire-illegal control frame larger than 125 bytes,
+// even though it fits comfortably within maxFrameLength.
+func TestWebSocketHandleWriteRejectsOversizedControlFrame(t *testing.T) {
+	w := WebSocketFrameCodec(1 << 16).(*webSocketFrameCodec)
+	msg := &WebSocketMessage{Type: WebSocketPing, Payload: bytes.Repeat([]byte{0}, 126)}
+
+	mustPanic(t, "ping payload > 125 bytes", func() {
+		w.HandleWrite(&fakeHandlerContext{}, msg)
+	})
+}